@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const pageSize = 4096
+
+// defaultFlushAfter is how long a slab can sit idle in the pool before the
+// janitor goroutine releases it back to the OS.
+const defaultFlushAfter = 60 * time.Second
+
+// slab is one pooled buffer. data is only set when the slab is mmap-backed,
+// so release() knows to munmap it rather than leaving it for the GC.
+type slab struct {
+	buf      *bytes.Buffer
+	data     []byte
+	lastUsed time.Time
+}
+
+// bp is a global, size-classed pool of reusable upload buffers. Workers
+// borrow a buffer with Get and return it with Put; a janitor goroutine
+// periodically releases buffers that have sat idle for longer than
+// flushAfter so a long-running swift-cli process doesn't keep peak memory
+// pinned for its whole lifetime. One bp is shared across every concurrent
+// largeObject (see sharedBufferPool), so -c 10 uploads running at once
+// don't each keep their own copy of the same idle buffers.
+type bp struct {
+	useMmap    bool
+	flushAfter time.Duration
+
+	mu      sync.Mutex
+	classes map[int64][]*slab
+
+	// mmapOrig tracks, for each mmap-backed buffer currently checked out of
+	// the pool, the original mmap'd array it was allocated with. A Write
+	// that pushes a buffer past that array's capacity makes bytes.Buffer
+	// silently reallocate onto the heap, so buf.Bytes() alone can no
+	// longer be trusted to find the array that actually needs munmapping.
+	mmapOrig map[*bytes.Buffer][]byte
+
+	quit chan bool
+}
+
+var (
+	sharedBufferPoolOnce sync.Once
+	sharedBufferPoolVal  *bp
+)
+
+// sharedBufferPool returns the process-wide buffer pool, creating it on
+// first use. useMmap and flushAfter only take effect on the first call;
+// later calls (e.g. from a second concurrent NewUploader) reuse whatever
+// the first caller configured.
+func sharedBufferPool(useMmap bool, flushAfter time.Duration) *bp {
+	sharedBufferPoolOnce.Do(func() {
+		sharedBufferPoolVal = newBufferPool(useMmap, flushAfter)
+	})
+	return sharedBufferPoolVal
+}
+
+// newBufferPool creates a size-classed slab pool and starts its janitor
+// goroutine. flushAfter <= 0 uses defaultFlushAfter.
+func newBufferPool(useMmap bool, flushAfter time.Duration) *bp {
+	if flushAfter <= 0 {
+		flushAfter = defaultFlushAfter
+	}
+	p := &bp{
+		useMmap:    useMmap,
+		flushAfter: flushAfter,
+		classes:    make(map[int64][]*slab),
+		mmapOrig:   make(map[*bytes.Buffer][]byte),
+		quit:       make(chan bool),
+	}
+	go p.janitor()
+	return p
+}
+
+// class rounds size up to the nearest page, so buffers of similar
+// requested sizes (bufsz only doubles, it doesn't vary continuously) land
+// in the same bucket and get reused instead of each triggering a fresh
+// allocation.
+func (p *bp) class(size int64) int64 {
+	return ((size + pageSize - 1) / pageSize) * pageSize
+}
+
+// Get returns a buffer with at least size capacity, reusing a pooled slab
+// of the same size class if one is free.
+func (p *bp) Get(size int64) *bytes.Buffer {
+	class := p.class(size)
+
+	p.mu.Lock()
+	free := p.classes[class]
+	if n := len(free); n > 0 {
+		s := free[n-1]
+		p.classes[class] = free[:n-1]
+		p.mu.Unlock()
+		s.buf.Reset()
+		return s.buf
+	}
+	p.mu.Unlock()
+
+	return p.alloc(class)
+}
+
+// Put returns buf to the pool, bucketed by its current capacity rounded down
+// to a whole page, so a later Get of that class never receives a buffer
+// smaller than the class. If buf was
+// mmap-backed but a Write grew it past that allocation's capacity,
+// bytes.Buffer has already silently reallocated it onto the heap; the
+// original mmap'd array is released right here instead of being mistaken
+// for buf's (now wrong) backing array and leaked.
+func (p *bp) Put(buf *bytes.Buffer) {
+	class := (int64(buf.Cap()) / pageSize) * pageSize
+
+	p.mu.Lock()
+	var data []byte
+	if orig, ok := p.mmapOrig[buf]; ok {
+		if cap(buf.Bytes()) > cap(orig) {
+			if err := syscall.Munmap(orig); err != nil {
+				debugf("bp: munmap failed: %v", err)
+			}
+			delete(p.mmapOrig, buf)
+		} else {
+			data = orig
+		}
+	}
+	p.classes[class] = append(p.classes[class], &slab{buf: buf, data: data, lastUsed: time.Now()})
+	p.mu.Unlock()
+}
+
+func (p *bp) alloc(class int64) *bytes.Buffer {
+	if !p.useMmap {
+		return bytes.NewBuffer(make([]byte, 0, class))
+	}
+	data, err := syscall.Mmap(-1, 0, int(class), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		// Fall back to a normal heap allocation rather than failing the
+		// upload over a pool optimization.
+		debugf("bp: mmap(%d) failed (%v), falling back to heap allocation", class, err)
+		return bytes.NewBuffer(make([]byte, 0, class))
+	}
+	buf := bytes.NewBuffer(data[:0])
+	p.mu.Lock()
+	p.mmapOrig[buf] = data
+	p.mu.Unlock()
+	return buf
+}
+
+// janitor releases slabs that have been idle for longer than flushAfter,
+// bounding the pool's steady-state memory use for long-running processes.
+func (p *bp) janitor() {
+	ticker := time.NewTicker(p.flushAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.sweep()
+		}
+	}
+}
+
+func (p *bp) sweep() {
+	cutoff := time.Now().Add(-p.flushAfter)
+
+	p.mu.Lock()
+	for class, free := range p.classes {
+		kept := free[:0]
+		for _, s := range free {
+			if s.lastUsed.Before(cutoff) {
+				p.release(s)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		p.classes[class] = kept
+	}
+	p.mu.Unlock()
+}
+
+// release gives a slab's memory back to the OS when it was mmap-backed;
+// ordinary heap buffers are simply dropped for the GC to collect. Callers
+// must hold p.mu.
+func (p *bp) release(s *slab) {
+	if s.data == nil {
+		return
+	}
+	if err := syscall.Munmap(s.data); err != nil {
+		debugf("bp: munmap failed: %v", err)
+	}
+	delete(p.mmapOrig, s.buf)
+}
+
+// Close stops the janitor goroutine. The shared pool is process-lifetime,
+// so this is mainly useful for tests.
+func (p *bp) Close() {
+	close(p.quit)
+}
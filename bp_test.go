@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBpClassRoundsUpToPageSize(t *testing.T) {
+	p := newBufferPool(false, time.Minute)
+	defer p.Close()
+
+	cases := map[int64]int64{
+		0:            0,
+		1:            pageSize,
+		pageSize:     pageSize,
+		pageSize + 1: 2 * pageSize,
+	}
+	for size, want := range cases {
+		if got := p.class(size); got != want {
+			t.Errorf("class(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestBpGetPutReusesSlab(t *testing.T) {
+	p := newBufferPool(false, time.Minute)
+	defer p.Close()
+
+	buf := p.Get(pageSize)
+	buf.WriteString("hello")
+	p.Put(buf)
+
+	again := p.Get(pageSize)
+	if again != buf {
+		t.Fatalf("Get after Put returned a different buffer, want the pooled one reused")
+	}
+	if again.Len() != 0 {
+		t.Fatalf("Get returned a buffer with leftover data: Len() = %d, want 0", again.Len())
+	}
+}
+
+func TestBpGetAllocatesFreshWhenPoolEmpty(t *testing.T) {
+	p := newBufferPool(false, time.Minute)
+	defer p.Close()
+
+	buf := p.Get(pageSize)
+	if cap(buf.Bytes()) < pageSize {
+		t.Fatalf("Get(%d) returned capacity %d, want at least %d", pageSize, cap(buf.Bytes()), pageSize)
+	}
+}
+
+func TestBpPutReallocatedMmapBufferDropsMmapOrig(t *testing.T) {
+	p := newBufferPool(true, time.Minute)
+	defer p.Close()
+
+	buf := p.Get(pageSize)
+	orig := p.mmapOrig[buf]
+	if orig == nil {
+		t.Fatalf("Get with useMmap true didn't register an mmapOrig entry")
+	}
+
+	// Force bytes.Buffer to reallocate onto the heap by writing past the
+	// mmap'd array's capacity.
+	buf.Write(make([]byte, cap(orig)+1))
+
+	p.Put(buf)
+
+	if _, ok := p.mmapOrig[buf]; ok {
+		t.Fatalf("Put left a stale mmapOrig entry for a reallocated buffer")
+	}
+}
+
+func TestBpSweepReleasesIdleSlabs(t *testing.T) {
+	p := newBufferPool(false, time.Minute)
+	defer p.Close()
+
+	buf := p.Get(pageSize)
+	p.Put(buf)
+
+	p.mu.Lock()
+	free := p.classes[p.class(pageSize)]
+	if len(free) != 1 {
+		p.mu.Unlock()
+		t.Fatalf("expected 1 free slab after Put, got %d", len(free))
+	}
+	free[0].lastUsed = time.Now().Add(-2 * p.flushAfter)
+	p.mu.Unlock()
+
+	p.sweep()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.classes[p.class(pageSize)]); n != 0 {
+		t.Fatalf("sweep left %d slabs past flushAfter, want 0", n)
+	}
+}
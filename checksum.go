@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// ChecksumAlgo is the digest algorithm used to compute the sidecar
+// checksum file swift put writes alongside an object, selectable via
+// --checksum-algo so users who can't rely on MD5 (e.g. in FIPS
+// environments) have somewhere else to turn. It never replaces the MD5
+// Swift itself uses to verify a segment's ETag - that check stays on
+// regardless of which algorithm is selected here.
+type ChecksumAlgo interface {
+	// Name identifies the algorithm for --checksum-algo and is used as the
+	// sidecar file's extension (<object>.<name>).
+	Name() string
+	// New returns a fresh hash.Hash for computing a digest.
+	New() hash.Hash
+	// MetaHeader is the Swift metadata header used to carry this
+	// algorithm's per-part digest, e.g. X-Object-Meta-Sha256. Empty for
+	// md5Algo, since Swift already exposes that one as the segment ETag.
+	MetaHeader() string
+}
+
+type md5Algo struct{}
+
+func (md5Algo) Name() string       { return "md5" }
+func (md5Algo) New() hash.Hash     { return md5.New() }
+func (md5Algo) MetaHeader() string { return "" }
+
+type sha256Algo struct{}
+
+func (sha256Algo) Name() string       { return "sha256" }
+func (sha256Algo) New() hash.Hash     { return sha256.New() }
+func (sha256Algo) MetaHeader() string { return "X-Object-Meta-Sha256" }
+
+// crc32cAlgo implements the Castagnoli variant of CRC32, the one commonly
+// used for S3-compatible checksums (x-amz-checksum-crc32c).
+type crc32cAlgo struct{}
+
+func (crc32cAlgo) Name() string       { return "crc32c" }
+func (crc32cAlgo) New() hash.Hash     { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }
+func (crc32cAlgo) MetaHeader() string { return "X-Object-Meta-Crc32c" }
+
+// blake3Algo uses the unkeyed, default-output-length (32-byte) BLAKE3 hash.
+type blake3Algo struct{}
+
+func (blake3Algo) Name() string       { return "blake3" }
+func (blake3Algo) New() hash.Hash     { return blake3.New(32, nil) }
+func (blake3Algo) MetaHeader() string { return "X-Object-Meta-Blake3" }
+
+var checksumAlgos = map[string]ChecksumAlgo{
+	"md5":    md5Algo{},
+	"sha256": sha256Algo{},
+	"crc32c": crc32cAlgo{},
+	"blake3": blake3Algo{},
+}
+
+func parseChecksumAlgo(name string) (ChecksumAlgo, error) {
+	algo, ok := checksumAlgos[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %q, must be one of md5, sha256, crc32c, blake3", name)
+	}
+	return algo, nil
+}
+
+// segmentDigest is one entry of the sidecar checksum file's segment list.
+type segmentDigest struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+}
+
+// digestSidecar is the JSON body written to <object>.<algo>, generalizing
+// the old single-hash .md5 sidecar to any ChecksumAlgo and to a full list
+// of per-segment digests (not just the whole-object one).
+type digestSidecar struct {
+	Algorithm string          `json:"algorithm"`
+	Digest    string          `json:"digest"`
+	Segments  []segmentDigest `json:"segments"`
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ncw/swift"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// copySegment describes one segment to copy from the source object's
+// segment container to the destination's.
+type copySegment struct {
+	index   int
+	srcName string
+}
+
+// largeObjectCopier drives a concurrent, server-side copy of a large
+// object's segments, mirroring the worker/retry/backoff structure that
+// largeObject uses for uploads.
+type largeObjectCopier struct {
+	c *swift.Connection
+
+	srcContainer string
+	dstContainer string
+	dstObject    string
+	timestamp    string
+
+	ch  chan copySegment
+	wg  sync.WaitGroup
+	err error
+
+	mu       sync.Mutex
+	segments []sloSegment
+}
+
+// CopyLargeObject server-side copies a Dynamic or Static Large Object from
+// srcContainer/srcObject to dstContainer/dstObject without downloading and
+// re-uploading its content: each segment is copied in place via a Swift
+// COPY (X-Copy-From), and a fresh manifest is written at the destination
+// once every segment lands. Use ObjectCopy for objects that aren't large
+// objects.
+func CopyLargeObject(c *swift.Connection, srcContainer, srcObject, dstContainer, dstObject string, concurrency int) error {
+	_, headers, err := c.Object(srcContainer, srcObject)
+	if err != nil {
+		return err
+	}
+
+	dloManifest, isDLO := headers["X-Object-Manifest"]
+	_, isSLO := headers["X-Static-Large-Object"]
+	if !isDLO && !isSLO {
+		return fmt.Errorf("%s/%s is not a large object, use ObjectCopy instead", srcContainer, srcObject)
+	}
+
+	segContainer, prefix := srcContainer+"_segments", srcObject+"/"
+	if isDLO {
+		parts := strings.SplitN(dloManifest, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("unexpected X-Object-Manifest value %q", dloManifest)
+		}
+		segContainer, prefix = parts[0], parts[1]
+	}
+
+	names, err := c.ObjectNamesAll(segContainer, &swift.ObjectsOpts{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%s/%s has no segments under %s/%s", srcContainer, srcObject, segContainer, prefix)
+	}
+	orderSegmentNames(names)
+
+	dstSegContainer := dstContainer + "_segments"
+	if err := c.ContainerCreate(dstSegContainer, nil); err != nil {
+		return err
+	}
+
+	lc := largeObjectCopier{
+		c:            c,
+		srcContainer: segContainer,
+		dstContainer: dstSegContainer,
+		dstObject:    dstObject,
+		timestamp:    fmt.Sprintf("%d", time.Now().UnixNano()),
+
+		ch:       make(chan copySegment),
+		segments: make([]sloSegment, len(names)),
+	}
+
+	for i := 0; i < max(concurrency, 1); i++ {
+		go lc.worker()
+	}
+
+	for i, name := range names {
+		lc.wg.Add(1)
+		lc.ch <- copySegment{index: i, srcName: name}
+	}
+	lc.wg.Wait()
+	close(lc.ch)
+
+	if lc.err != nil {
+		return lc.err
+	}
+
+	if isSLO {
+		return lc.completeSLO(dstContainer)
+	}
+	return lc.completeDLO(dstContainer)
+}
+
+func (lc *largeObjectCopier) worker() {
+	for seg := range lc.ch {
+		lc.retryCopySegment(seg)
+	}
+}
+
+// retryCopySegment calls copySegment up to nTry times to recover from
+// transient errors, same backoff as largeObject.retryPutPart.
+func (lc *largeObjectCopier) retryCopySegment(seg copySegment) {
+	defer lc.wg.Done()
+	var err error
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Duration(math.Exp2(float64(i))) * 100 * time.Millisecond) // exponential back-off
+		err = lc.copySegment(seg)
+		if err == nil {
+			return
+		}
+		debugf("Error on attempt %d: Retrying segment copy: %v, Error: %s", i, seg, err)
+	}
+	lc.err = err
+}
+
+func (lc *largeObjectCopier) copySegment(seg copySegment) error {
+	dstName := fmt.Sprintf("%s/%s/%08d", lc.dstObject, lc.timestamp, seg.index+1)
+
+	debug("copySegment(", lc.srcContainer, seg.srcName, "->", lc.dstContainer, dstName, ")")
+
+	_, _, err := swiftCall(lc.c, swift.RequestOpts{
+		Container:  lc.dstContainer,
+		ObjectName: dstName,
+		Operation:  "PUT",
+		Headers:    swift.Headers{"X-Copy-From": lc.srcContainer + "/" + seg.srcName},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, headers, err := lc.c.Object(lc.dstContainer, dstName)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(headers["Content-Length"], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	lc.mu.Lock()
+	lc.segments[seg.index] = sloSegment{
+		Path:      lc.dstContainer + "/" + dstName,
+		ETag:      headers["Etag"],
+		SizeBytes: size,
+	}
+	lc.mu.Unlock()
+	return nil
+}
+
+// completeSLO PUTs a Static Large Object manifest at dstContainer/dstObject
+// listing every copied segment in order.
+func (lc *largeObjectCopier) completeSLO(dstContainer string) error {
+	body, err := json.Marshal(lc.segments)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ { //NTry
+		_, _, err = swiftCall(lc.c, swift.RequestOpts{
+			Container:  dstContainer,
+			ObjectName: lc.dstObject,
+			Operation:  "PUT",
+			Parameters: url.Values{"multipart-manifest": {"put"}},
+			Body:       bytes.NewReader(body),
+		})
+		if err == nil {
+			break
+		}
+	}
+	return err
+}
+
+// completeDLO writes the X-Object-Manifest tying the copied segments
+// together into a Dynamic Large Object.
+func (lc *largeObjectCopier) completeDLO(dstContainer string) error {
+	reqHeaders := map[string]string{"X-Object-Manifest": lc.dstContainer + "/" + lc.dstObject + "/" + lc.timestamp}
+	var err error
+	for i := 0; i < 3; i++ { //NTry
+		_, err = lc.c.ObjectPut(dstContainer, lc.dstObject, strings.NewReader(""), true, "", "", reqHeaders)
+		if err == nil {
+			break
+		}
+	}
+	return err
+}
+
+// orderSegmentNames sorts segment object names in place by their trailing
+// numeric part number, falling back to lexical order for names that don't
+// end in a number.
+func orderSegmentNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		ni, oki := trailingSegmentNumber(names[i])
+		nj, okj := trailingSegmentNumber(names[j])
+		if oki && okj {
+			return ni < nj
+		}
+		return names[i] < names[j]
+	})
+}
+
+func trailingSegmentNumber(name string) (int, bool) {
+	parts := strings.Split(name, "/")
+	n, err := strconv.Atoi(parts[len(parts)-1])
+	return n, err == nil
+}
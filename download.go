@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/ncw/swift"
+	"golang.org/x/time/rate"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultChunkSize is the range size used to split a large or
+	// oversized object for parallel download when it isn't an SLO (whose
+	// existing segment boundaries are used instead).
+	defaultChunkSize = 20 * 1024 * 1024
+
+	// rangeParallelThreshold is the size from which cmdGet bothers
+	// splitting a plain object into ranges; below this, one ObjectGet is
+	// cheaper than spinning up workers.
+	rangeParallelThreshold = 100 * 1024 * 1024
+)
+
+// sloManifestEntry is one segment of a Static Large Object manifest, as
+// returned by GET ?multipart-manifest=get.
+type sloManifestEntry struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+// downloadChunk describes one fetch for the parallel downloader: either a
+// byte range of container/object (wholeObject false), or - for an SLO's
+// segments - the whole of a distinct source object (wholeObject true), in
+// which case etag, if set, is checked against the manifest before the data
+// is trusted.
+type downloadChunk struct {
+	index       int
+	offset      int64
+	length      int64
+	container   string
+	object      string
+	wholeObject bool
+	etag        string
+}
+
+// largeObjectDownloader drives a concurrent, range-parallel download into
+// dst, mirroring the worker/retry/backoff structure largeObject uses for
+// uploads and largeObjectCopier uses for server-side copies.
+type largeObjectDownloader struct {
+	c       *swift.Connection
+	dst     *os.File
+	limiter *rate.Limiter
+
+	ch chan downloadChunk
+	wg sync.WaitGroup
+
+	// quit is closed by abort on the first unrecoverable chunk error, so
+	// workers stop pulling new chunks off ch and fetchChunk stops doing any
+	// more I/O for one already in flight, instead of every other chunk
+	// running to completion against a download that's already doomed.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// abort records err (if one isn't already recorded) and signals every
+// worker to stop touching dst.
+func (ld *largeObjectDownloader) abort(err error) {
+	ld.mu.Lock()
+	if ld.err == nil {
+		ld.err = err
+	}
+	ld.mu.Unlock()
+	ld.quitOnce.Do(func() { close(ld.quit) })
+}
+
+// aborted reports whether abort has already been called.
+func (ld *largeObjectDownloader) aborted() bool {
+	select {
+	case <-ld.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// RangeGetObject downloads container/object into dst in parallel. SLO
+// objects are split along their existing segment boundaries, with each
+// segment's ETag checked against the manifest when verify is true; anything
+// else (a plain object of at least rangeParallelThreshold, or a DLO, whose total
+// size Swift reports via Content-Length the same as a plain object) is split
+// into chunkSize Range requests instead. bwlimit caps combined download
+// bandwidth in bytes/sec across all workers; 0 means unlimited.
+//
+// isSLO and size are the caller's own HEAD result (cmdGet already has to
+// inspect it to decide whether to call RangeGetObject at all), so this
+// doesn't re-HEAD the object itself.
+func RangeGetObject(c *swift.Connection, container, object string, dst *os.File, concurrency int, chunkSize int64, verify bool, bwlimit int64, isSLO bool, size int64) error {
+	var chunks []downloadChunk
+	var err error
+	if isSLO {
+		chunks, err = sloChunks(c, container, object, verify)
+		if err != nil {
+			return err
+		}
+	} else {
+		chunks = rangeChunks(container, object, size, chunkSize)
+	}
+	if len(chunks) == 0 {
+		return fmt.Errorf("%s/%s has nothing to download", container, object)
+	}
+
+	if err := dst.Truncate(totalSize(chunks)); err != nil {
+		return err
+	}
+
+	ld := &largeObjectDownloader{
+		c:       c,
+		dst:     dst,
+		limiter: newRateLimiter(bwlimit),
+		ch:      make(chan downloadChunk),
+		quit:    make(chan struct{}),
+	}
+
+	for i := 0; i < max(concurrency, 1); i++ {
+		go ld.worker()
+	}
+feed:
+	for _, chunk := range chunks {
+		if ld.aborted() {
+			break feed
+		}
+		ld.wg.Add(1)
+		select {
+		case ld.ch <- chunk:
+		case <-ld.quit:
+			ld.wg.Done()
+			break feed
+		}
+	}
+	ld.wg.Wait()
+	close(ld.ch)
+
+	if ld.err != nil {
+		// Leave no silently-corrupt file behind: a chunk mismatch means dst
+		// is only partially (or wrongly) written.
+		if rmErr := os.Remove(dst.Name()); rmErr != nil && !os.IsNotExist(rmErr) {
+			debugf("RangeGetObject: leaving partial %s after error (%v): %v", dst.Name(), ld.err, rmErr)
+		}
+	}
+	return ld.err
+}
+
+// sloChunks fetches the manifest for an SLO and turns each segment it lists
+// into one whole-object downloadChunk, in order.
+func sloChunks(c *swift.Connection, container, object string, verify bool) ([]downloadChunk, error) {
+	resp, _, err := swiftCall(c, swift.RequestOpts{
+		Container:  container,
+		ObjectName: object,
+		Operation:  "GET",
+		Parameters: url.Values{"multipart-manifest": {"get"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []sloManifestEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decoding SLO manifest for %s/%s: %v", container, object, err)
+	}
+
+	chunks := make([]downloadChunk, len(entries))
+	var offset int64
+	for i, e := range entries {
+		segContainer, segObject := splitManifestName(e.Name)
+		chunk := downloadChunk{
+			index:       i,
+			offset:      offset,
+			length:      e.Bytes,
+			container:   segContainer,
+			object:      segObject,
+			wholeObject: true,
+		}
+		if verify {
+			chunk.etag = e.Hash
+		}
+		chunks[i] = chunk
+		offset += e.Bytes
+	}
+	return chunks, nil
+}
+
+// splitManifestName splits a manifest entry's "name" field (e.g.
+// "/container/object/ts/1" or "container/object/ts/1") into its segment
+// container and object name.
+func splitManifestName(name string) (string, string) {
+	name = strings.TrimPrefix(name, "/")
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// rangeChunks splits a size-byte object into chunkSize Range requests.
+func rangeChunks(container, object string, size, chunkSize int64) []downloadChunk {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	n := int((size + chunkSize - 1) / chunkSize)
+	if n < 1 {
+		n = 1
+	}
+	chunks := make([]downloadChunk, n)
+	for i := 0; i < n; i++ {
+		offset := int64(i) * chunkSize
+		chunks[i] = downloadChunk{
+			index:     i,
+			offset:    offset,
+			length:    min64(chunkSize, size-offset),
+			container: container,
+			object:    object,
+		}
+	}
+	return chunks
+}
+
+// totalSize returns the byte offset one past the end of the last chunk, so
+// the destination file can be sized up front regardless of completion order.
+func totalSize(chunks []downloadChunk) int64 {
+	var total int64
+	for _, c := range chunks {
+		if end := c.offset + c.length; end > total {
+			total = end
+		}
+	}
+	return total
+}
+
+func (ld *largeObjectDownloader) worker() {
+	for chunk := range ld.ch {
+		if ld.aborted() {
+			ld.wg.Done()
+			continue
+		}
+		ld.retryFetchChunk(chunk)
+	}
+}
+
+// retryFetchChunk calls fetchChunk up to nTry times to recover from
+// transient errors, same backoff as largeObject.retryPutPart. A failure on
+// the last attempt aborts the whole download: other chunks still queued or
+// in flight stop touching dst instead of racing to completion against a
+// download that's already lost.
+func (ld *largeObjectDownloader) retryFetchChunk(chunk downloadChunk) {
+	defer ld.wg.Done()
+	var err error
+	for i := 0; i < 3; i++ {
+		if ld.aborted() {
+			return
+		}
+		time.Sleep(time.Duration(math.Exp2(float64(i))) * 100 * time.Millisecond) // exponential back-off
+		err = ld.fetchChunk(chunk)
+		if err == nil {
+			return
+		}
+		debugf("Error on attempt %d: Retrying chunk: %v, Error: %s", i, chunk, err)
+	}
+	ld.abort(err)
+}
+
+// fetchChunk downloads one chunk and writes it into dst at its offset. For a
+// whole-segment chunk with a non-empty etag, it aborts on either an ETag
+// header mismatch or, belt-and-braces, a mismatch between the ETag and the
+// MD5 of the bytes actually received.
+func (ld *largeObjectDownloader) fetchChunk(chunk downloadChunk) error {
+	if ld.aborted() {
+		return fmt.Errorf("download aborted")
+	}
+
+	reqHeaders := swift.Headers{}
+	if !chunk.wholeObject {
+		reqHeaders["Range"] = fmt.Sprintf("bytes=%d-%d", chunk.offset, chunk.offset+chunk.length-1)
+	}
+
+	debug("fetchChunk(", chunk.container, chunk.object, chunk.offset, chunk.length, ")")
+
+	resp, headers, err := swiftCall(ld.c, swift.RequestOpts{
+		Container:  chunk.container,
+		ObjectName: chunk.object,
+		Operation:  "GET",
+		Headers:    reqHeaders,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if chunk.etag != "" {
+		if s := strings.Trim(headers["Etag"], "\""); s != chunk.etag {
+			return fmt.Errorf("segment %s/%s etag mismatch: remote %s, manifest %s", chunk.container, chunk.object, s, chunk.etag)
+		}
+	}
+
+	buf := make([]byte, chunk.length)
+	if _, err := io.ReadFull(throttleReader(resp.Body, ld.limiter), buf); err != nil {
+		return err
+	}
+
+	if chunk.etag != "" {
+		if sum := fmt.Sprintf("%x", md5.Sum(buf)); sum != chunk.etag {
+			return fmt.Errorf("segment %s/%s content hash mismatch: got %s, manifest %s", chunk.container, chunk.object, sum, chunk.etag)
+		}
+	}
+
+	if ld.aborted() {
+		return fmt.Errorf("download aborted")
+	}
+	_, err = ld.dst.WriteAt(buf, chunk.offset)
+	return err
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"github.com/emccode/swift"
+	"github.com/ncw/swift"
+	"golang.org/x/time/rate"
 	"hash"
 	"io"
 	"math"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -22,6 +26,53 @@ const (
 	maxObjSize  = 5 * 1024 * 1024 * 1024 * 1024
 )
 
+// concurrencyAuto is the concurrency sentinel for --concurrency auto: start
+// at one worker and let the adaptive controller grow or shrink the pool
+// (see throttle.go).
+const concurrencyAuto = -1
+
+// uploadMmapEnabled and uploadPoolFlushTime configure the shared buffer
+// pool (see sharedBufferPool in bp.go). They're set from the --upload-mmap
+// and --upload-pool-flush-time flags before the first NewUploader of a
+// process runs; later uploaders in the same process share whatever pool
+// that first call creates.
+var (
+	uploadMmapEnabled   = false
+	uploadPoolFlushTime = defaultFlushAfter
+)
+
+// UploadMode selects how the segments of a large object upload are tied
+// together into a single addressable object.
+type UploadMode int
+
+const (
+	// DLO builds a Dynamic Large Object manifest (X-Object-Manifest). Swift
+	// stitches the segments together at GET time based on a name prefix, but
+	// never validates the segments against each other.
+	DLO UploadMode = iota
+	// SLO builds a Static Large Object manifest: the client PUTs an explicit,
+	// ordered list of segments and Swift verifies each one's ETag and size
+	// against what was actually stored before accepting the manifest.
+	SLO
+)
+
+// String returns the --manifest-mode flag value for mode, used in resume
+// journal mismatch errors.
+func (mode UploadMode) String() string {
+	if mode == SLO {
+		return "slo"
+	}
+	return "dlo"
+}
+
+// sloSegment is one entry of a Static Large Object manifest, as documented at
+// https://docs.openstack.org/api-ref/object-store/#create-static-large-object
+type sloSegment struct {
+	Path      string `json:"path"`
+	ETag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
 type part struct {
 	r   io.ReadSeeker
 	len int64
@@ -33,6 +84,10 @@ type part struct {
 
 	// Used for checksum of checksums on completion
 	contentMd5 string
+
+	// digest is this part's hex digest under lo.algo, sent as a metadata
+	// header on the segment and recorded in the sidecar checksum file.
+	digest string
 }
 
 type largeObject struct {
@@ -41,6 +96,7 @@ type largeObject struct {
 	objectName string
 	timestamp  string
 	expire     string
+	mode       UploadMode
 
 	bufsz      int64
 	buf        *bytes.Buffer
@@ -50,7 +106,45 @@ type largeObject struct {
 	err        error
 	wg         sync.WaitGroup
 	md5OfParts hash.Hash
-	md5        hash.Hash
+
+	// algo, digestHash and partDigests back the pluggable checksum sidecar
+	// (see checksum.go). md5OfParts above is unaffected by the choice
+	// of algo: it always tracks MD5 because that's what Swift itself uses
+	// to verify a segment's ETag and to compute an SLO manifest's ETag.
+	algo        ChecksumAlgo
+	digestHash  hash.Hash
+	partDigests map[int]string
+
+	// segments and manifestWritten are only used in SLO mode: segments
+	// records each successfully-uploaded part keyed by PartNumber (workers
+	// finish out of order), and manifestWritten lets abort() fall back to a
+	// one-shot manifest delete once the manifest has actually been PUT.
+	segMu           sync.Mutex
+	segments        map[int]sloSegment
+	manifestWritten bool
+
+	// stateDir, journalPath and journalParts back resumable uploads (see
+	// resume.go). stateDir is empty for a plain NewUploader, in which case
+	// no journal is written.
+	stateDir     string
+	journalPath  string
+	journalMu    sync.Mutex
+	journalParts []journalPart
+
+	// limiter throttles every worker's segment PUTs to a shared --bwlimit
+	// budget; nil means unlimited.
+	limiter *rate.Limiter
+
+	// adaptive, maxWorkers, tokens and adaptiveQuit back --concurrency
+	// auto (see throttle.go); bytesSent and throttled are the counters the
+	// adaptive controller watches. Unused when adaptive is false, in which
+	// case worker() goroutines are spawned once, up front, as before.
+	adaptive     bool
+	maxWorkers   int
+	tokens       chan struct{}
+	adaptiveQuit chan struct{}
+	bytesSent    int64
+	throttled    int32
 
 	bp *bp
 }
@@ -71,30 +165,53 @@ type largeObject struct {
 // and overwrites, etc. You can override this behavior with the --leave-segments
 // option if desired; this is useful if you want to have multiple versions of
 // the same large object available.
-func NewUploader(c *swift.Connection, path string, concurrency int, partSize int64, expireAfter int64) (*largeObject, error) {
+//
+// concurrency is the number of parts to upload at once, or concurrencyAuto
+// to start at one worker and adapt up to maxAdaptiveWorkers based on
+// observed throughput and retry rate. bwlimit caps combined upload
+// bandwidth in bytes/sec across all workers; 0 means unlimited.
+func NewUploader(c *swift.Connection, path string, concurrency int, partSize int64, expireAfter int64, mode UploadMode, algo ChecksumAlgo, bwlimit int64) (*largeObject, error) {
 	pathParts := strings.SplitN(path, "/", 2)
 	objectName := "upload"
 	if len(pathParts) > 1 {
 		objectName = pathParts[1]
 	}
+	if algo == nil {
+		algo = md5Algo{}
+	}
 	lo := largeObject{
 		c:          c,
 		container:  pathParts[0],
 		objectName: objectName,
 		timestamp:  fmt.Sprintf("%d", time.Now().UnixNano()),
 		expire:     fmt.Sprintf("%d", expireAfter),
+		mode:       mode,
+		algo:       algo,
+		limiter:    newRateLimiter(bwlimit),
 
 		bufsz: max64(minPartSize, partSize),
 
-		ch:         make(chan *part),
-		md5OfParts: md5.New(),
-		md5:        md5.New(),
-
-		bp: newBufferPool(minPartSize),
-	}
-
-	for i := 0; i < max(concurrency, 1); i++ {
-		go lo.worker()
+		ch:          make(chan *part),
+		md5OfParts:  md5.New(),
+		digestHash:  algo.New(),
+		partDigests: make(map[int]string),
+		segments:    make(map[int]sloSegment),
+
+		bp: sharedBufferPool(uploadMmapEnabled, uploadPoolFlushTime),
+	}
+
+	if concurrency == concurrencyAuto {
+		lo.adaptive = true
+		lo.maxWorkers = maxAdaptiveWorkers
+		lo.tokens = make(chan struct{}, lo.maxWorkers)
+		lo.tokens <- struct{}{} // start at a single active worker
+		lo.adaptiveQuit = make(chan struct{})
+		go lo.dispatch()
+		go lo.adaptiveController()
+	} else {
+		for i := 0; i < max(concurrency, 1); i++ {
+			go lo.worker()
+		}
 	}
 
 	// Create segment container if it doesn't already exist
@@ -116,8 +233,7 @@ func (lo *largeObject) Write(b []byte) (int, error) {
 		return 0, lo.err
 	}
 	if lo.buf == nil {
-		lo.buf = <-lo.bp.get
-		lo.buf.Reset()
+		lo.buf = lo.bp.Get(lo.bufsz)
 	}
 	n, err := lo.buf.Write(b)
 	if err != nil {
@@ -135,9 +251,9 @@ func (lo *largeObject) flush() {
 	lo.wg.Add(1)
 	lo.part++
 	b := *lo.buf
-	part := &part{bytes.NewReader(b.Bytes()), int64(b.Len()), lo.buf, lo.part, "", ""}
+	part := &part{bytes.NewReader(b.Bytes()), int64(b.Len()), lo.buf, lo.part, "", "", ""}
 	var err error
-	part.contentMd5, part.ETag, err = lo.md5Content(part.r)
+	part.contentMd5, part.ETag, part.digest, err = lo.digestContent(part.r)
 	if err != nil {
 		lo.err = err
 	}
@@ -167,9 +283,16 @@ func (lo *largeObject) retryPutPart(part *part) {
 		time.Sleep(time.Duration(math.Exp2(float64(i))) * 100 * time.Millisecond) // exponential back-off
 		err = lo.putPart(part)
 		if err == nil {
-			lo.bp.give <- part.b
+			atomic.AddInt64(&lo.bytesSent, part.len)
+			lo.bp.Put(part.b)
+			if lo.stateDir != "" {
+				lo.journalRecordPart(part)
+			}
 			return
 		}
+		if isThrottled(err) {
+			atomic.AddInt32(&lo.throttled, 1)
+		}
 		debugf("Error on attempt %d: Retrying part: %v, Error: %s", i, part, err)
 	}
 	lo.err = err
@@ -186,7 +309,12 @@ func (lo *largeObject) putPart(part *part) error {
 		return err
 	}
 
-	headers, err := lo.c.ObjectPut(container, objectName, part.r, true, "", "", nil)
+	var reqHeaders swift.Headers
+	if h := lo.algo.MetaHeader(); h != "" {
+		reqHeaders = swift.Headers{h: part.digest}
+	}
+
+	headers, err := lo.c.ObjectPut(container, objectName, throttleReader(part.r, lo.limiter), true, "", "", reqHeaders)
 	if err != nil {
 		return err
 	}
@@ -195,6 +323,17 @@ func (lo *largeObject) putPart(part *part) error {
 	if part.ETag != s {
 		return fmt.Errorf("Response etag does not match. Remote:%s Calculated:%s", s, part.ETag)
 	}
+
+	lo.segMu.Lock()
+	if lo.mode == SLO {
+		lo.segments[part.PartNumber] = sloSegment{
+			Path:      container + "/" + objectName,
+			ETag:      s,
+			SizeBytes: part.len,
+		}
+	}
+	lo.partDigests[part.PartNumber] = part.digest
+	lo.segMu.Unlock()
 	return nil
 }
 
@@ -212,7 +351,11 @@ func (lo *largeObject) Close() (err error) {
 	lo.wg.Wait()
 	close(lo.ch)
 	lo.closed = true
-	lo.bp.quit <- true
+	if lo.adaptive {
+		close(lo.adaptiveQuit)
+	}
+	// lo.bp is the shared, process-wide pool (see sharedBufferPool); it
+	// outlives this uploader and is not torn down here.
 
 	if lo.part == 0 {
 		lo.abort()
@@ -222,7 +365,23 @@ func (lo *largeObject) Close() (err error) {
 		lo.abort()
 		return lo.err
 	}
-	// Complete Multipart upload
+	if lo.mode == SLO {
+		err = lo.completeSLO()
+	} else {
+		err = lo.completeDLO()
+	}
+	if err != nil {
+		return err
+	}
+	if lo.stateDir != "" {
+		lo.journalRemove()
+	}
+	return nil
+}
+
+// completeDLO writes the X-Object-Manifest that ties the uploaded segments
+// together into a Dynamic Large Object.
+func (lo *largeObject) completeDLO() (err error) {
 	debug("completeMultipart(", lo.container, lo.objectName, "X-Object-Manifest: ", lo.container+"_segments/"+lo.objectName+"/"+lo.timestamp, ")")
 
 	reqHeaders := map[string]string{"X-Object-Manifest": lo.container + "_segments/" + lo.objectName + "/" + lo.timestamp}
@@ -244,37 +403,100 @@ func (lo *largeObject) Close() (err error) {
 	}
 	debugf("completeMultipart() Response: %#v", headers)
 
-	// Check md5 hash of concatenated part md5 hashes against ETag
-	/* Broken right now
-	_, hdrs, err := lo.c.Object(lo.container, lo.objectName)
+	for i := 0; i < 3; i++ { //NTry
+		if err = lo.putDigestSidecar(); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return err
 	}
-	calculatedMd5ofParts := fmt.Sprintf("%x", lo.md5OfParts.Sum(nil))
-	remoteMd5ofParts := hdrs["Etag"]
-	remoteMd5ofParts = remoteMd5ofParts[1 : len(remoteMd5ofParts)-1] // includes quote chars for some reason
-	if calculatedMd5ofParts != remoteMd5ofParts {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("MD5 hash of part hashes comparison failed. Hash from multipart complete header: %s."+
-			" Calculated multipart hash: %s.", remoteMd5ofParts, calculatedMd5ofParts)
-	}
-	*/
-	if false { //Md5Check
-		for i := 0; i < 3; i++ { //NTry
-			if err = lo.putMd5(); err == nil {
-				break
-			}
+	// DLO has no server-computed hash of the manifest to compare against,
+	// so the closest completion check available is confirming the sidecar
+	// we just wrote is actually readable back.
+	return lo.verifySidecar()
+}
+
+// completeSLO PUTs a Static Large Object manifest listing every segment in
+// order. Swift re-checks each segment's ETag and size against what it
+// actually stored, so (unlike DLO) a corrupted segment is rejected here
+// instead of silently surfacing on a later GET.
+func (lo *largeObject) completeSLO() (err error) {
+	manifest := make([]sloSegment, lo.part)
+	lo.segMu.Lock()
+	for i := 1; i <= lo.part; i++ {
+		manifest[i-1] = lo.segments[i]
+	}
+	lo.segMu.Unlock()
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		lo.abort()
+		return err
+	}
+
+	reqHeaders := swift.Headers{}
+	if lo.expire != "0" {
+		reqHeaders["X-Delete-After"] = lo.expire
+	}
+
+	debug("completeMultipart(", lo.container, lo.objectName, "multipart-manifest=put,", len(manifest), "segments )")
+
+	var headers swift.Headers
+	for i := 0; i < 3; i++ { //NTry
+		_, headers, err = swiftCall(lo.c, swift.RequestOpts{
+			Container:  lo.container,
+			ObjectName: lo.objectName,
+			Operation:  "PUT",
+			Parameters: url.Values{"multipart-manifest": {"put"}},
+			Headers:    reqHeaders,
+			Body:       bytes.NewReader(body),
+		})
+		if err == nil {
+			break
 		}
-		return
 	}
-	return
+	if err != nil {
+		lo.abort()
+		return err
+	}
+	lo.manifestWritten = true
+	debugf("completeMultipart() Response: %#v", headers)
+
+	// Swift computes an SLO manifest's ETag as the MD5 of the concatenated
+	// segment MD5s, so - unlike DLO - we can actually check the once-broken
+	// "md5 of md5s" comparison by reading it straight back off the PUT
+	// response, with no extra round trip. md5OfParts tracks MD5 whatever
+	// --checksum-algo is, so this check runs under every algorithm.
+	calculated := fmt.Sprintf("%x", lo.md5OfParts.Sum(nil))
+	remote := strings.Trim(headers["Etag"], "\"")
+	if calculated != remote {
+		return fmt.Errorf("MD5 hash of part hashes comparison failed. Hash from manifest PUT response: %s."+
+			" Calculated: %s.", remote, calculated)
+	}
+	return lo.putDigestSidecar()
 }
 
 // Try to abort multipart upload. Do not error on failure.
 func (lo *largeObject) abort() {
 	debug("abort()")
+	if lo.mode == SLO && lo.manifestWritten {
+		// The manifest is already live: a single delete with
+		// multipart-manifest=delete removes it and every segment it
+		// references, instead of us re-discovering and deleting them one
+		// by one.
+		debug("abort(): deleting SLO manifest", lo.container, lo.objectName, "in one shot")
+		_, _, err := swiftCall(lo.c, swift.RequestOpts{
+			Container:  lo.container,
+			ObjectName: lo.objectName,
+			Operation:  "DELETE",
+			Parameters: url.Values{"multipart-manifest": {"delete"}},
+		})
+		if err != nil {
+			fmt.Printf("Error aborting multipart upload: %v\n", err)
+		}
+		return
+	}
 	objects, err := lo.c.ObjectNamesAll(lo.container+"_segments", nil)
 	if err != nil {
 		fmt.Printf("Error aborting multipart upload: %v\n", err)
@@ -291,31 +513,77 @@ func (lo *largeObject) abort() {
 	return
 }
 
-// Md5 functions
-func (lo *largeObject) md5Content(r io.ReadSeeker) (string, string, error) {
-	h := md5.New()
-	mw := io.MultiWriter(h, lo.md5)
+// digestContent hashes a part's content once, feeding both the MD5 Swift
+// itself needs (to verify the segment's ETag, and an SLO manifest's ETag)
+// and, under the chosen ChecksumAlgo, this part's own digest. It returns
+// the base64 MD5 for ObjectPut, the hex MD5 for ETag comparison, and the
+// part's hex digest under lo.algo.
+//
+// lo.digestHash - the whole-object digest written to the sidecar file - is
+// fed this part's digest rather than its raw content, the same
+// hash-of-part-hashes construction lo.md5OfParts already uses for the SLO
+// manifest ETag. That's what lets a resumed upload replay both from the
+// journal's recorded per-part digests instead of re-reading part content
+// that was never re-hashed (see journalRecordPart/NewResumableUploader).
+func (lo *largeObject) digestContent(r io.ReadSeeker) (string, string, string, error) {
+	md5h := md5.New()
+	algoh := lo.algo.New()
+	mw := io.MultiWriter(md5h, algoh)
 	if _, err := io.Copy(mw, r); err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	sum := h.Sum(nil)
+	sum := md5h.Sum(nil)
 	hexSum := fmt.Sprintf("%x", sum)
 	// add to checksum of all parts for verification on upload completion
 	if _, err := lo.md5OfParts.Write(sum); err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	return base64.StdEncoding.EncodeToString(sum), hexSum, nil
+	algoSum := algoh.Sum(nil)
+	if _, err := lo.digestHash.Write(algoSum); err != nil {
+		return "", "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sum), hexSum, fmt.Sprintf("%x", algoSum), nil
 }
 
-// Put md5 file in .md5 subdirectory of bucket  where the file is stored
-// e.g. the md5 for https://mybucket.s3.amazonaws.com/gof3r will be stored in
-// https://mybucket.s3.amazonaws.com/gof3r.md5
-func (lo *largeObject) putMd5() (err error) {
-	calcMd5 := fmt.Sprintf("%x", lo.md5.Sum(nil))
-	md5Reader := strings.NewReader(calcMd5)
-	debug("putMd5()", calcMd5, lo.container+"/"+lo.objectName+".md5")
-	_, err = lo.c.ObjectPut(lo.container, lo.objectName+".md5", md5Reader, true, "", "", nil)
-	return
+// putDigestSidecar writes <object>.<algo>, generalizing the old .md5
+// sidecar: it records the whole-object digest plus a per-segment digest
+// list, so an integrity check doesn't need to re-download and re-hash the
+// whole object, just compare against this file. The whole-object digest is
+// the digest of the per-part digests in order (see digestContent), not a
+// digest of the object's raw bytes.
+func (lo *largeObject) putDigestSidecar() error {
+	sidecar := digestSidecar{
+		Algorithm: lo.algo.Name(),
+		Digest:    fmt.Sprintf("%x", lo.digestHash.Sum(nil)),
+		Segments:  make([]segmentDigest, lo.part),
+	}
+	lo.segMu.Lock()
+	for i := 1; i <= lo.part; i++ {
+		sidecar.Segments[i-1] = segmentDigest{
+			Path:   lo.container + "_segments/" + lo.objectName + "/" + lo.timestamp + "/" + fmt.Sprintf("%d", i),
+			Digest: lo.partDigests[i],
+		}
+	}
+	lo.segMu.Unlock()
+
+	body, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	sidecarName := lo.objectName + "." + lo.algo.Name()
+	debug("putDigestSidecar()", lo.container+"/"+sidecarName)
+	_, err = lo.c.ObjectPut(lo.container, sidecarName, bytes.NewReader(body), true, "", "application/json", nil)
+	return err
+}
+
+// verifySidecar confirms the sidecar file written by putDigestSidecar
+// actually landed, by HEADing it back - the closest thing to a completion
+// check available in DLO mode, where (unlike SLO) Swift has no composite
+// ETag of its own to compare against.
+func (lo *largeObject) verifySidecar() error {
+	sidecarName := lo.objectName + "." + lo.algo.Name()
+	_, _, err := lo.c.Object(lo.container, sidecarName)
+	return err
 }
 
 // Min and Max functions
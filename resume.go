@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ncw/swift"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// journal is the on-disk record of a resumable upload's progress. It is
+// written to stateDir as parts complete (see largeObject.journalRecordPart)
+// and removed on a clean Close(), so a restart can pick up exactly where the
+// previous run left off instead of re-uploading everything.
+//
+// Mode and Algo record the manifest mode and checksum algorithm the
+// interrupted run used; NewResumableUploader refuses to resume a journal
+// written under different flags, since replaying the hashing state below
+// only makes sense for the algorithm (and mode) it was recorded under.
+type journal struct {
+	Container  string        `json:"container"`
+	ObjectName string        `json:"object_name"`
+	Timestamp  string        `json:"timestamp"`
+	PartSize   int64         `json:"part_size"`
+	Mode       UploadMode    `json:"mode"`
+	Algo       string        `json:"algo"`
+	Parts      []journalPart `json:"parts"`
+}
+
+// journalPart records one segment that was confirmed uploaded. Digest is
+// its hex digest under the journal's Algo, recorded so a resumed upload can
+// replay lo.digestHash and lo.partDigests without re-reading (and
+// re-hashing) part content that resumeSeek skipped past.
+type journalPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	MD5        string `json:"md5"`
+	Digest     string `json:"digest"`
+}
+
+// NewResumableUploader is like NewUploader, but persists a journal of
+// completed parts under stateDir as the upload proceeds. When resume is
+// true and a journal from a previous, interrupted run of the same object
+// exists, it confirms each recorded segment is still present in Swift and
+// picks up from the next part number instead of starting over.
+//
+// It returns the uploader and the number of input bytes already accounted
+// for by verified segments; the caller is responsible for seeking (or
+// discarding, for a non-seekable reader) that many bytes from the input
+// before copying into the returned writer. Use resumeSeek for that.
+func NewResumableUploader(c *swift.Connection, path string, stateDir string, concurrency int, partSize int64, expireAfter int64, mode UploadMode, algo ChecksumAlgo, bwlimit int64, resume bool) (*largeObject, int64, error) {
+	journalPath := journalPathFor(stateDir, path)
+
+	var j *journal
+	if resume {
+		var err error
+		j, err = loadJournal(journalPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, fmt.Errorf("reading resume journal %s: %v", journalPath, err)
+		}
+	}
+
+	lo, err := NewUploader(c, path, concurrency, partSize, expireAfter, mode, algo, bwlimit)
+	if err != nil {
+		return nil, 0, err
+	}
+	lo.stateDir = stateDir
+	lo.journalPath = journalPath
+
+	if j == nil {
+		if resume {
+			debug("resume: no usable journal at", journalPath, "- starting fresh upload")
+		}
+		return lo, 0, nil
+	}
+
+	if j.Mode != mode || j.Algo != algo.Name() {
+		return nil, 0, fmt.Errorf("resume journal %s was started with --manifest-mode %s --checksum-algo %s, not %s/%s;"+
+			" rerun with the original flags or delete the journal to start over",
+			journalPath, j.Mode, j.Algo, mode, algo.Name())
+	}
+
+	verified, offset, err := verifyJournalParts(c, j)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lo.timestamp = j.Timestamp
+	lo.bufsz = j.PartSize
+	lo.part = len(verified)
+	lo.journalParts = verified
+	for _, p := range verified {
+		if mode == SLO {
+			lo.segments[p.PartNumber] = sloSegment{
+				Path:      lo.container + "_segments/" + lo.objectName + "/" + lo.timestamp + "/" + strconv.Itoa(p.PartNumber),
+				ETag:      p.ETag,
+				SizeBytes: p.Size,
+			}
+		}
+		if err := lo.replayPartDigest(p); err != nil {
+			return nil, 0, fmt.Errorf("resume journal %s: %v", journalPath, err)
+		}
+	}
+	debugf("resume: picked up %s/%s at timestamp %s, %d parts already uploaded (%d bytes)",
+		lo.container, lo.objectName, lo.timestamp, lo.part, offset)
+
+	return lo, offset, nil
+}
+
+// replayPartDigest feeds one already-uploaded part's recorded hashes into
+// lo.md5OfParts and lo.digestHash, the same running hashes digestContent
+// updates for a part as it's uploaded (see lo.go), and records its digest
+// in lo.partDigests. Without this, completeSLO's "md5 of md5s" check (and,
+// for any other --checksum-algo, the sidecar's whole-object digest) would
+// only ever cover the parts uploaded after a --resume, not the ones picked
+// up from the journal.
+func (lo *largeObject) replayPartDigest(p journalPart) error {
+	md5Sum, err := hex.DecodeString(p.MD5)
+	if err != nil {
+		return fmt.Errorf("part %d: decoding journal md5 %q: %v", p.PartNumber, p.MD5, err)
+	}
+	if _, err := lo.md5OfParts.Write(md5Sum); err != nil {
+		return err
+	}
+
+	digestSum, err := hex.DecodeString(p.Digest)
+	if err != nil {
+		return fmt.Errorf("part %d: decoding journal digest %q: %v", p.PartNumber, p.Digest, err)
+	}
+	if _, err := lo.digestHash.Write(digestSum); err != nil {
+		return err
+	}
+	lo.partDigests[p.PartNumber] = p.Digest
+	return nil
+}
+
+// journalRecordPart appends a successfully-uploaded part to the journal and
+// rewrites it to stateDir. Called from retryPutPart once a part's ETag has
+// been confirmed.
+func (lo *largeObject) journalRecordPart(part *part) {
+	lo.journalMu.Lock()
+	defer lo.journalMu.Unlock()
+
+	lo.journalParts = append(lo.journalParts, journalPart{
+		PartNumber: part.PartNumber,
+		ETag:       part.ETag,
+		Size:       part.len,
+		MD5:        part.ETag,
+		Digest:     part.digest,
+	})
+
+	j := journal{
+		Container:  lo.container,
+		ObjectName: lo.objectName,
+		Timestamp:  lo.timestamp,
+		PartSize:   lo.bufsz,
+		Mode:       lo.mode,
+		Algo:       lo.algo.Name(),
+		Parts:      lo.journalParts,
+	}
+	if err := writeJournal(lo.journalPath, &j); err != nil {
+		fmt.Printf("Error writing resume journal %s: %v\n", lo.journalPath, err)
+	}
+}
+
+// journalRemove deletes the journal file after a successful Close().
+func (lo *largeObject) journalRemove() {
+	if err := os.Remove(lo.journalPath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing resume journal %s: %v\n", lo.journalPath, err)
+	}
+}
+
+func journalPathFor(stateDir, path string) string {
+	name := strings.Replace(path, "/", "_", -1)
+	return filepath.Join(stateDir, name+".swift-resume.json")
+}
+
+func loadJournal(journalPath string) (*journal, error) {
+	b, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	var j journal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func writeJournal(journalPath string, j *journal) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(journalPath, b, 0600)
+}
+
+// verifyJournalParts confirms that every part recorded in j still exists in
+// the segments container with the expected ETag and size, stopping at the
+// first gap or mismatch (Swift may have expired or the prior run may have
+// died mid-segment-write). It returns the prefix of parts still good to use
+// and the number of input bytes they cover.
+func verifyJournalParts(c *swift.Connection, j *journal) ([]journalPart, int64, error) {
+	container := j.Container + "_segments"
+	var verified []journalPart
+	var offset int64
+	// Parts are journaled in completion order, which concurrent workers
+	// don't keep in PartNumber order.
+	sort.Slice(j.Parts, func(a, b int) bool { return j.Parts[a].PartNumber < j.Parts[b].PartNumber })
+	for i, p := range j.Parts {
+		if p.PartNumber != i+1 {
+			debugf("resume: journal part %d out of sequence, stopping verification", p.PartNumber)
+			break
+		}
+		objectName := j.ObjectName + "/" + j.Timestamp + "/" + strconv.Itoa(p.PartNumber)
+		_, headers, err := c.Object(container, objectName)
+		if err != nil {
+			debugf("resume: segment %s/%s missing (%v), stopping verification", container, objectName, err)
+			break
+		}
+		if headers["Etag"] != p.ETag {
+			debugf("resume: segment %s/%s etag mismatch (remote %s, journal %s), stopping verification",
+				container, objectName, headers["Etag"], p.ETag)
+			break
+		}
+		verified = append(verified, p)
+		offset += p.Size
+	}
+	return verified, offset, nil
+}
+
+// resumeSeek advances r past the first offset bytes of already-uploaded
+// data. Seekable readers (regular files) seek directly; non-seekable
+// readers (e.g. piped stdin) are read and discarded up to offset instead.
+//
+// r is typically *os.File, including os.Stdin, so the io.Seeker assertion
+// below succeeds even when stdin is actually a pipe; the real signal that
+// a reader isn't seekable only shows up once Seek is attempted and fails
+// with ESPIPE, so that case falls through to the discard loop too.
+func resumeSeek(r io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.ESPIPE) {
+			return err
+		}
+	}
+	_, err := io.CopyN(ioutil.Discard, r, offset)
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift"
+)
+
+// swiftTestConnection returns a Connection authenticated (v1 auth) against
+// srv, so its storage requests land back on srv too - the same object
+// server handles both the auth handshake and the subsequent HEADs.
+func swiftTestConnection(t *testing.T, srv *httptest.Server) *swift.Connection {
+	t.Helper()
+	c := &swift.Connection{
+		UserName: "test",
+		ApiKey:   "test",
+		AuthUrl:  srv.URL + "/auth/v1.0",
+	}
+	if err := c.Authenticate(); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	return c
+}
+
+func TestVerifyJournalPartsStopsAtMissingSegment(t *testing.T) {
+	etags := map[string]string{
+		"obj/ts/1": "etag1",
+		"obj/ts/2": "etag2",
+		// part 3 deliberately missing, simulating an expired or never-written segment
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/auth/") {
+			w.Header().Set("X-Auth-Token", "test-token")
+			w.Header().Set("X-Storage-Url", srv.URL)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/container_segments/")
+		etag, ok := etags[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Etag", etag)
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	j := &journal{
+		Container:  "container",
+		ObjectName: "obj",
+		Timestamp:  "ts",
+		Parts: []journalPart{
+			{PartNumber: 1, ETag: "etag1", Size: 5},
+			{PartNumber: 2, ETag: "etag2", Size: 5},
+			{PartNumber: 3, ETag: "etag3", Size: 5},
+		},
+	}
+
+	verified, offset, err := verifyJournalParts(swiftTestConnection(t, srv), j)
+	if err != nil {
+		t.Fatalf("verifyJournalParts: %v", err)
+	}
+	if len(verified) != 2 {
+		t.Fatalf("got %d verified parts, want 2 (part 3 is missing remotely)", len(verified))
+	}
+	if offset != 10 {
+		t.Fatalf("got offset %d, want 10", offset)
+	}
+}
+
+func TestVerifyJournalPartsStopsOnEtagMismatch(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/auth/") {
+			w.Header().Set("X-Auth-Token", "test-token")
+			w.Header().Set("X-Storage-Url", srv.URL)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/container_segments/")
+		if name == "obj/ts/1" {
+			w.Header().Set("Etag", "etag1")
+			w.Header().Set("Content-Length", "5")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if name == "obj/ts/2" {
+			// Remote part exists but its content no longer matches what the
+			// journal recorded (e.g. overwritten by an unrelated run).
+			w.Header().Set("Etag", "different-etag")
+			w.Header().Set("Content-Length", "5")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	j := &journal{
+		Container:  "container",
+		ObjectName: "obj",
+		Timestamp:  "ts",
+		Parts: []journalPart{
+			{PartNumber: 1, ETag: "etag1", Size: 5},
+			{PartNumber: 2, ETag: "etag2", Size: 5},
+		},
+	}
+
+	verified, offset, err := verifyJournalParts(swiftTestConnection(t, srv), j)
+	if err != nil {
+		t.Fatalf("verifyJournalParts: %v", err)
+	}
+	if len(verified) != 1 {
+		t.Fatalf("got %d verified parts, want 1 (part 2's etag mismatches)", len(verified))
+	}
+	if offset != 5 {
+		t.Fatalf("got offset %d, want 5", offset)
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.json")
+
+	j := &journal{
+		Container:  "c",
+		ObjectName: "o",
+		Timestamp:  "ts",
+		PartSize:   1024,
+		Mode:       SLO,
+		Algo:       "sha256",
+		Parts: []journalPart{
+			{PartNumber: 1, ETag: "e1", Size: 5, MD5: "deadbeef", Digest: "cafebabe"},
+		},
+	}
+	if err := writeJournal(path, j); err != nil {
+		t.Fatalf("writeJournal: %v", err)
+	}
+
+	got, err := loadJournal(path)
+	if err != nil {
+		t.Fatalf("loadJournal: %v", err)
+	}
+	if got.Mode != SLO || got.Algo != "sha256" || len(got.Parts) != 1 || got.Parts[0].Digest != "cafebabe" {
+		t.Fatalf("loadJournal round-trip mismatch: got %+v", got)
+	}
+}
+
+func TestReplayPartDigestFeedsRunningHashes(t *testing.T) {
+	lo := &largeObject{
+		md5OfParts:  md5.New(),
+		digestHash:  md5.New(),
+		partDigests: make(map[int]string),
+	}
+
+	part1 := []byte("part one content")
+	part2 := []byte("part two content")
+	md5_1 := md5.Sum(part1)
+	md5_2 := md5.Sum(part2)
+
+	parts := []journalPart{
+		{PartNumber: 1, MD5: hex.EncodeToString(md5_1[:]), Digest: hex.EncodeToString(md5_1[:])},
+		{PartNumber: 2, MD5: hex.EncodeToString(md5_2[:]), Digest: hex.EncodeToString(md5_2[:])},
+	}
+	for _, p := range parts {
+		if err := lo.replayPartDigest(p); err != nil {
+			t.Fatalf("replayPartDigest(%+v): %v", p, err)
+		}
+	}
+
+	wantMd5OfParts := md5.New()
+	wantMd5OfParts.Write(md5_1[:])
+	wantMd5OfParts.Write(md5_2[:])
+	if got, want := fmt.Sprintf("%x", lo.md5OfParts.Sum(nil)), fmt.Sprintf("%x", wantMd5OfParts.Sum(nil)); got != want {
+		t.Errorf("md5OfParts = %s, want %s", got, want)
+	}
+
+	if got := lo.partDigests[1]; got != parts[0].Digest {
+		t.Errorf("partDigests[1] = %s, want %s", got, parts[0].Digest)
+	}
+	if got := lo.partDigests[2]; got != parts[1].Digest {
+		t.Errorf("partDigests[2] = %s, want %s", got, parts[1].Digest)
+	}
+}
+
+func TestReplayPartDigestRejectsBadHex(t *testing.T) {
+	lo := &largeObject{
+		md5OfParts:  md5.New(),
+		digestHash:  md5.New(),
+		partDigests: make(map[int]string),
+	}
+	err := lo.replayPartDigest(journalPart{PartNumber: 1, MD5: "not-hex", Digest: "cafebabe"})
+	if err == nil {
+		t.Fatal("replayPartDigest accepted a non-hex MD5, want an error")
+	}
+}
+
+func TestResumeSeekSeekable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := resumeSeek(f, 5); err != nil {
+		t.Fatalf("resumeSeek: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "56789" {
+		t.Fatalf("got %q after resumeSeek, want %q", rest, "56789")
+	}
+}
+
+func TestResumeSeekNonSeekablePipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		defer w.Close()
+		w.Write([]byte("0123456789"))
+	}()
+
+	if err := resumeSeek(r, 5); err != nil {
+		t.Fatalf("resumeSeek: %v", err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "56789" {
+		t.Fatalf("got %q after resumeSeek on a pipe, want %q", rest, "56789")
+	}
+}
+
+func TestJournalPathForReplacesSlashes(t *testing.T) {
+	got := journalPathFor("/state", "a/b/c")
+	want := filepath.Join("/state", "a_b_c.swift-resume.json")
+	if got != want {
+		t.Errorf("journalPathFor = %s, want %s", got, want)
+	}
+}
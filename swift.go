@@ -7,8 +7,12 @@ import (
 	"github.com/spf13/cobra"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -72,15 +76,24 @@ func main() {
 	}
 	rootCmd.AddCommand(cmdLs)
 
-	var flConcurrency *int
+	var flConcurrency *string
 	var flPartSize *int64
 	var flExpireAfter *int64
+	var flManifestMode *string
+	var flResume *bool
+	var flStateDir *string
+	var flUploadMmap *bool
+	var flUploadPoolFlushTime *time.Duration
+	var flChecksumAlgo *string
+	var flBwlimit *string
 
 	var cmdPut = &cobra.Command{
 		Use:   "put fromfile container[/object] OR put container[/object] < stream",
 		Short: "upload (put) an object",
 		Run: func(cmd *cobra.Command, args []string) {
 			parseDefaultFlags(*flDebug)
+			uploadMmapEnabled = *flUploadMmap
+			uploadPoolFlushTime = *flUploadPoolFlushTime
 			c := connect()
 
 			switch {
@@ -110,12 +123,48 @@ func main() {
 				fileOut = args[1]
 			}
 
-			w, err := NewUploader(c, fileOut, *flConcurrency, *flPartSize, *flExpireAfter)
+			mode, err := parseUploadMode(*flManifestMode)
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
-			if _, err = io.Copy(w, r); err != nil {
+			algo, err := parseChecksumAlgo(*flChecksumAlgo)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			concurrency, err := parseConcurrency(*flConcurrency)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			bwlimit, err := parseBandwidth(*flBwlimit)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			var w *largeObject
+			var in io.Reader = r
+			if *flResume {
+				var offset int64
+				w, offset, err = NewResumableUploader(c, fileOut, *flStateDir, concurrency, *flPartSize, *flExpireAfter, mode, algo, bwlimit, true)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				if err = resumeSeek(r, offset); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			} else {
+				w, err = NewUploader(c, fileOut, concurrency, *flPartSize, *flExpireAfter, mode, algo, bwlimit)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+			if _, err = io.Copy(w, in); err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
@@ -125,11 +174,23 @@ func main() {
 			}
 		},
 	}
-	flConcurrency = cmdPut.Flags().IntP("concurrency", "c", 10, "Concurrency of transfers")
+	flConcurrency = cmdPut.Flags().StringP("concurrency", "c", "10", "Concurrency of transfers, or \"auto\" to adapt to observed throughput")
 	flPartSize = cmdPut.Flags().Int64P("partsize", "s", 20971520, "Initial size of concurrent parts, in bytes")
 	flExpireAfter = cmdPut.Flags().Int64P("expire", "e", 0, "Number of seconds to expire document after")
+	flManifestMode = cmdPut.Flags().StringP("manifest-mode", "m", "slo", "Large object manifest type to write: dlo or slo")
+	flResume = cmdPut.Flags().Bool("resume", false, "Resume an interrupted upload using the journal in --state-dir")
+	flStateDir = cmdPut.Flags().String("state-dir", ".", "Directory to store the resume journal in")
+	flUploadMmap = cmdPut.Flags().Bool("upload-mmap", false, "Back upload buffers with anonymous mmap instead of the Go heap")
+	flUploadPoolFlushTime = cmdPut.Flags().Duration("upload-pool-flush-time", defaultFlushAfter, "How long an idle upload buffer is kept before being released")
+	flChecksumAlgo = cmdPut.Flags().String("checksum-algo", "md5", "Checksum algorithm for the sidecar digest file: md5, sha256, crc32c or blake3")
+	flBwlimit = cmdPut.Flags().String("bwlimit", "", "Cap combined upload bandwidth, e.g. 10M; empty means unlimited")
 	rootCmd.AddCommand(cmdPut)
 
+	var flGetBwlimit *string
+	var flGetConcurrency *int
+	var flGetChunkSize *int64
+	var flGetVerify *bool
+
 	var cmdGet = &cobra.Command{
 		Use:   "get container[/object] tofile OR get container[/object] > tofile",
 		Short: "download (get) an object",
@@ -152,14 +213,21 @@ func main() {
 				os.Exit(1)
 			}
 
+			bwlimit, err := parseBandwidth(*flGetBwlimit)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
 			var w io.Writer
 			var bw *bufio.Writer
+			var outFile *os.File
 
 			switch {
 			case len(args) == 1:
 				w = os.Stdout
 			case len(args) == 2:
-				outFile, err := os.Create(args[1])
+				outFile, err = os.Create(args[1])
 				if err != nil {
 					log.Fatal(err)
 					os.Exit(1)
@@ -170,7 +238,33 @@ func main() {
 				defer bw.Flush()
 			}
 
-			_, err := c.ObjectGet(pathParts[0], pathParts[1], w, false, nil)
+			// A range-parallel download needs pwrite-style random access, so
+			// it's only available when writing to a real file, not stdout.
+			if outFile != nil {
+				_, headers, err := c.Object(pathParts[0], pathParts[1])
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				_, isDLO := headers["X-Object-Manifest"]
+				_, isSLO := headers["X-Static-Large-Object"]
+				size, err := strconv.ParseInt(headers["Content-Length"], 10, 64)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
+				if isDLO || isSLO || size >= rangeParallelThreshold {
+					err = RangeGetObject(c, pathParts[0], pathParts[1], outFile, *flGetConcurrency, *flGetChunkSize, *flGetVerify, bwlimit, isSLO, size)
+					if err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+					return
+				}
+			}
+
+			_, err = c.ObjectGet(pathParts[0], pathParts[1], throttleWriter(w, newRateLimiter(bwlimit)), false, nil)
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -178,6 +272,10 @@ func main() {
 
 		},
 	}
+	flGetBwlimit = cmdGet.Flags().String("bwlimit", "", "Cap download bandwidth, e.g. 10M; empty means unlimited")
+	flGetConcurrency = cmdGet.Flags().IntP("concurrency", "c", 10, "Concurrency of range/segment fetches for large or oversized objects")
+	flGetChunkSize = cmdGet.Flags().Int64P("chunk-size", "s", defaultChunkSize, "Size of each ranged fetch, in bytes, for non-SLO objects")
+	flGetVerify = cmdGet.Flags().Bool("verify", true, "For SLO objects, verify each segment's ETag against the manifest")
 	rootCmd.AddCommand(cmdGet)
 
 	var cmdDelete = &cobra.Command{
@@ -200,14 +298,32 @@ func main() {
 				fmt.Println(err)
 				os.Exit(1)
 			}
-			largeObjectPrefix, largeObject := headers["X-Object-Manifest"]
+			dloManifest, isDLO := headers["X-Object-Manifest"]
+			_, isSLO := headers["X-Static-Large-Object"]
+
+			if isSLO {
+				// A single delete with multipart-manifest=delete removes
+				// the manifest and every segment it references.
+				_, _, err = swiftCall(c, swift.RequestOpts{
+					Container:  pathParts[0],
+					ObjectName: pathParts[1],
+					Operation:  "DELETE",
+					Parameters: url.Values{"multipart-manifest": {"delete"}},
+				})
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				return
+			}
+
 			err = c.ObjectDelete(pathParts[0], pathParts[1])
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
-			if largeObject {
-				loParts := strings.SplitN(largeObjectPrefix, "/", 2)
+			if isDLO {
+				loParts := strings.SplitN(dloManifest, "/", 2)
 				objects, err := c.ObjectNamesAll(loParts[0], nil)
 				if err != nil {
 					fmt.Println(err)
@@ -226,9 +342,61 @@ func main() {
 	}
 	rootCmd.AddCommand(cmdDelete)
 
+	var flCpConcurrency *int
+
+	var cmdCp = &cobra.Command{
+		Use:   "cp srccontainer/srcobject dstcontainer/dstobject",
+		Short: "copy an object, server-side",
+		Run: func(cmd *cobra.Command, args []string) {
+			parseDefaultFlags(*flDebug)
+			c := connect()
+			if len(args) != 2 {
+				fmt.Println("Must specify source and destination container/object")
+				os.Exit(1)
+			}
+			srcParts := strings.SplitN(args[0], "/", 2)
+			dstParts := strings.SplitN(args[1], "/", 2)
+			if len(srcParts) <= 1 || len(dstParts) <= 1 {
+				fmt.Println("Must specify full object paths (container/object)")
+				os.Exit(1)
+			}
+
+			_, headers, err := c.Object(srcParts[0], srcParts[1])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			_, isDLO := headers["X-Object-Manifest"]
+			_, isSLO := headers["X-Static-Large-Object"]
+
+			if isDLO || isSLO {
+				err = CopyLargeObject(c, srcParts[0], srcParts[1], dstParts[0], dstParts[1], *flCpConcurrency)
+			} else {
+				_, err = c.ObjectCopy(srcParts[0], srcParts[1], dstParts[0], dstParts[1], nil)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+	flCpConcurrency = cmdCp.Flags().IntP("concurrency", "c", 10, "Concurrency of segment copies for large objects")
+	rootCmd.AddCommand(cmdCp)
+
 	rootCmd.Execute()
 }
 
+func parseUploadMode(mode string) (UploadMode, error) {
+	switch strings.ToLower(mode) {
+	case "slo":
+		return SLO, nil
+	case "dlo":
+		return DLO, nil
+	default:
+		return DLO, fmt.Errorf("unknown manifest mode %q, must be dlo or slo", mode)
+	}
+}
+
 func parseDefaultFlags(flDebug bool) {
 	if flDebug {
 		os.Setenv("DEBUG", "1")
@@ -247,6 +415,18 @@ func debugf(fmt string, v ...interface{}) {
 	}
 }
 
+// swiftCall runs a raw request against the storage URL for operations
+// ncw/swift has no dedicated method for (SLO manifest PUT/DELETE, segment
+// copy, SLO manifest GET). It fills in targetUrl and re-auth the same way
+// Connection's own unexported storage() helper does; p.Container and
+// p.ObjectName (not positional arguments) select the object.
+func swiftCall(c *swift.Connection, p swift.RequestOpts) (*http.Response, swift.Headers, error) {
+	p.OnReAuth = func() (string, error) {
+		return c.StorageUrl, nil
+	}
+	return c.Call(c.StorageUrl, p)
+}
+
 func connect() *swift.Connection {
 	c := swift.Connection{
 		// This should be your username
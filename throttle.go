@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ncw/swift"
+	"golang.org/x/time/rate"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxAdaptiveWorkers bounds how high --concurrency auto will climb. It's
+// deliberately modest: past this, a single host's network/CPU is rarely
+// the bottleneck and more workers just mean more contention on the Swift
+// proxy.
+const maxAdaptiveWorkers = 32
+
+// newRateLimiter builds a token-bucket limiter sized to bytesPerSec, or
+// returns nil (meaning "unlimited") when bytesPerSec <= 0. The burst size
+// matches the rate, so at most one second's budget is spent at once;
+// limitedReader and limitedWriter split larger reads and writes to fit it.
+func newRateLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+}
+
+// limitedReader throttles reads against a shared rate.Limiter so every
+// worker pulls from the same global --bwlimit budget instead of each
+// getting its own.
+type limitedReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func throttleReader(r io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: limiter}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// WaitN rejects any n above the burst, so never read more than that.
+	if b := lr.limiter.Burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.WaitN(context.Background(), n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// limitedWriter is the download-side counterpart to limitedReader, used to
+// throttle swift get the same way swift put is throttled.
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func throttleWriter(w io.Writer, limiter *rate.Limiter) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &limitedWriter{w: w, limiter: limiter}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if b := lw.limiter.Burst(); len(chunk) > b {
+			chunk = chunk[:b]
+		}
+		if err := lw.limiter.WaitN(context.Background(), len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// parseConcurrency parses a --concurrency flag value: a plain integer, or
+// the literal "auto" for concurrencyAuto.
+func parseConcurrency(s string) (int, error) {
+	if strings.ToLower(s) == "auto" {
+		return concurrencyAuto, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --concurrency %q, must be a number or \"auto\"", s)
+	}
+	return n, nil
+}
+
+// parseBandwidth parses a --bwlimit flag value such as "10M" or "512K"
+// into bytes/sec. A bare number is treated as bytes/sec. "" or "0"
+// (however suffixed) disables the limit.
+func parseBandwidth(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch suffix := s[len(s)-1]; suffix {
+	case 'k', 'K':
+		mult, s = 1024, s[:len(s)-1]
+	case 'm', 'M':
+		mult, s = 1024*1024, s[:len(s)-1]
+	case 'g', 'G':
+		mult, s = 1024*1024*1024, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --bwlimit %q, must be a byte count optionally suffixed with K, M or G", s)
+	}
+	return n * mult, nil
+}
+
+// isThrottled reports whether err is a Swift 429 (Too Many Requests) or
+// 503 (Service Unavailable) response, the signal the adaptive concurrency
+// controller backs off on.
+func isThrottled(err error) bool {
+	se, ok := err.(*swift.Error)
+	if !ok {
+		return false
+	}
+	return se.StatusCode == 429 || se.StatusCode == 503
+}
+
+// dispatch is the --concurrency auto alternative to the fixed pool of
+// worker() goroutines: it hands each part to its own goroutine gated by a
+// token from lo.tokens, whose count adaptiveController grows or shrinks
+// over the life of the upload.
+func (lo *largeObject) dispatch() {
+	for p := range lo.ch {
+		<-lo.tokens
+		go func(p *part) {
+			defer func() { lo.tokens <- struct{}{} }()
+			lo.retryPutPart(p)
+		}(p)
+	}
+}
+
+// adaptiveController starts at one active worker and, every tick, grows
+// the pool while throughput keeps improving and no part has been
+// throttled, or shrinks it by one the moment a 429/503 is observed. It
+// never exceeds maxAdaptiveWorkers.
+func (lo *largeObject) adaptiveController() {
+	const tick = 2 * time.Second
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	current := 1
+	var lastBytes int64
+	var lastThroughput float64
+
+	for {
+		select {
+		case <-lo.adaptiveQuit:
+			return
+		case <-ticker.C:
+			bytes := atomic.LoadInt64(&lo.bytesSent)
+			throttled := atomic.SwapInt32(&lo.throttled, 0)
+			throughput := float64(bytes-lastBytes) / tick.Seconds()
+			lastBytes = bytes
+
+			switch {
+			case throttled > 0 && current > 1:
+				current--
+				go func() { <-lo.tokens }() // permanently retire one token
+				debugf("adaptive: backing off to %d workers after %d throttled response(s)", current, throttled)
+			case throttled == 0 && throughput > lastThroughput*1.05 && current < lo.maxWorkers:
+				current++
+				lo.tokens <- struct{}{}
+				debugf("adaptive: scaling up to %d workers (%.0f B/s)", current, throughput)
+			}
+			lastThroughput = throughput
+		}
+	}
+}